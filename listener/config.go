@@ -0,0 +1,33 @@
+package listener
+
+import "time"
+
+// RAWListenerConfig groups the optional settings for RAWTCPListen. Its zero
+// value preserves today's default behaviour: the "tcp dst port N" filter, no
+// packet dump, no bound on in-flight messages.
+type RAWListenerConfig struct {
+	// DumpFile, when set, tees every captured packet to this path via
+	// pcapgo.Writer, so a live session can be replayed later through
+	// NewOfflinePacketSource (e.g. `--input-raw file://dump.pcap`).
+	DumpFile string
+
+	// DumpRotateSize rotates DumpFile once it grows past this many bytes.
+	// Zero disables size-based rotation.
+	DumpRotateSize int64
+
+	// DumpRotateInterval rotates DumpFile after this much time has elapsed
+	// since it was (re)opened. Zero disables time-based rotation.
+	DumpRotateInterval time.Duration
+
+	// BPFFilter, when set, overrides the default "tcp dst port N" filter
+	// with an arbitrary tcpdump expression, e.g.
+	// "tcp and (port 80 or port 8080) and net 10.0.0.0/8".
+	BPFFilter string
+
+	// MaxInFlightMessages bounds how many TCPMessages RAWTCPListener will
+	// reassemble at once. Zero leaves it unbounded. Once the limit is hit,
+	// the oldest in-flight message is expired (flushed with whatever has
+	// been reassembled so far) to make room for the new one, so a flood of
+	// half-open connections can't grow memory without bound.
+	MaxInFlightMessages int
+}
@@ -0,0 +1,26 @@
+package listener
+
+import "sync/atomic"
+
+// Metrics holds the running counters for a RAWTCPListener. They're plain
+// atomic counters rather than registered expvar vars, so embedding a
+// listener never risks a duplicate-name panic if more than one is created
+// in the same process; wire them into your own expvar.Map or /metrics
+// endpoint if you want them exported.
+type Metrics struct {
+	// PacketsReceived counts packets handed off to processTCPPacket.
+	PacketsReceived atomic.Int64
+
+	// PacketsDropped counts packets discarded because c_packets was full,
+	// i.e. the reassembly side couldn't keep up with capture.
+	PacketsDropped atomic.Int64
+
+	// MessagesInFlight is a gauge of TCPMessages currently being
+	// reassembled.
+	MessagesInFlight atomic.Int64
+
+	// MessagesExpired counts messages flushed without a clean
+	// boundary/FIN/RST: by the idle timeout, by eviction under
+	// RAWListenerConfig.MaxInFlightMessages, or by the drain in Close.
+	MessagesExpired atomic.Int64
+}
@@ -0,0 +1,124 @@
+package listener
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// PacketSource abstracts over the different ways RAWTCPListener can obtain
+// raw packets: a live capture off a NIC, an offline replay of a previously
+// recorded pcap file, or a Linux af_packet socket (see
+// packet_source_linux.go, reachable through the "af_packet://" device
+// scheme in startSniffer). Capturing this as an interface lets tests and
+// regression tooling feed a canned pcap file through the exact same
+// processing path used in production, instead of requiring root and a
+// live interface.
+//
+// *pcap.Handle already satisfies this interface, so live and offline
+// sources are thin wrappers around pcap.OpenLive/pcap.OpenOffline.
+type PacketSource interface {
+	gopacket.PacketDataSource
+
+	// LinkType reports the link-layer type so packets can be decoded
+	// without assuming Ethernet.
+	LinkType() layers.LinkType
+
+	// SetBPFFilter installs a tcpdump-style filter expression.
+	SetBPFFilter(expr string) error
+
+	// Close releases the underlying handle.
+	Close()
+}
+
+// NewLivePacketSource opens a live capture on the given network device.
+func NewLivePacketSource(device string, snaplen int32, promisc bool, timeout time.Duration) (PacketSource, error) {
+	return pcap.OpenLive(device, snaplen, promisc, timeout)
+}
+
+// NewOfflinePacketSource replays packets previously recorded to a pcap file.
+// This is what powers the `file://` input-raw scheme: operators can capture
+// a production session once (see RAWListenerConfig.DumpFile) and replay it
+// locally as many times as needed without touching a live interface.
+func NewOfflinePacketSource(path string) (PacketSource, error) {
+	return pcap.OpenOffline(path)
+}
+
+const fileScheme = "file://"
+
+func stripFileScheme(addr string) (path string, ok bool) {
+	if len(addr) > len(fileScheme) && addr[:len(fileScheme)] == fileScheme {
+		return addr[len(fileScheme):], true
+	}
+
+	return "", false
+}
+
+const afPacketScheme = "af_packet://"
+
+// stripAFPacketScheme reports whether addr selects the AF_PACKET capture
+// path (see NewAFPacketSource / packet_source_linux.go), returning the
+// bare device name with the scheme removed.
+func stripAFPacketScheme(addr string) (device string, ok bool) {
+	if len(addr) > len(afPacketScheme) && addr[:len(afPacketScheme)] == afPacketScheme {
+		return addr[len(afPacketScheme):], true
+	}
+
+	return "", false
+}
+
+// findPcapDevices resolves addr into the pcap device names RAWTCPListener
+// should capture on. An empty addr matches every interface that has at
+// least one address configured. A non-empty addr may be a single IP or a
+// CIDR (e.g. "10.0.0.0/8"), matched against each interface's configured
+// addresses, which is what lets bonded/multi-homed hosts capture on every
+// interface that can see the target traffic. If addr matches no interface
+// address, it is returned as-is so a plain device name (e.g. "eth0") keeps
+// working.
+func findPcapDevices(addr string) ([]string, error) {
+	devices, err := pcap.FindAllDevs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ipNet *net.IPNet
+
+	if addr != "" && strings.Contains(addr, "/") {
+		if _, ipNet, err = net.ParseCIDR(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	ip := net.ParseIP(addr)
+
+	var names []string
+
+	for _, device := range devices {
+		if addr == "" {
+			if len(device.Addresses) > 0 {
+				names = append(names, device.Name)
+			}
+
+			continue
+		}
+
+		for _, a := range device.Addresses {
+			if (ipNet != nil && ipNet.Contains(a.IP)) || (ip != nil && ip.Equal(a.IP)) {
+				names = append(names, device.Name)
+
+				break
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return []string{addr}, nil
+	}
+
+	return names, nil
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package listener
+
+import (
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketSource adapts a Linux AF_PACKET socket (gopacket/afpacket.TPacket)
+// to the PacketSource interface. Unlike NewLivePacketSource, it captures
+// without going through libpcap's live-capture path at all; libpcap is
+// only used here to compile a tcpdump filter expression into the raw BPF
+// program TPacket.SetBPF expects.
+type afpacketSource struct {
+	*afpacket.TPacket
+}
+
+// NewAFPacketSource opens an AF_PACKET socket bound to device. It always
+// reports an Ethernet link type, since AF_PACKET sockets deliver frames
+// starting at the link layer.
+func NewAFPacketSource(device string, snaplen int) (PacketSource, error) {
+	handle, err := afpacket.NewTPacket(
+		afpacket.OptInterface(device),
+		afpacket.OptFrameSize(snaplen),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &afpacketSource{TPacket: handle}, nil
+}
+
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// SetBPFFilter compiles expr via libpcap and installs the resulting
+// program on the socket, so the same tcpdump-style filter expressions
+// work across every PacketSource implementation.
+func (s *afpacketSource) SetBPFFilter(expr string) error {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65536, expr)
+	if err != nil {
+		return err
+	}
+
+	raw := make([]bpf.RawInstruction, len(instructions))
+
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: ins.Code,
+			Jt: ins.Jt,
+			Jf: ins.Jf,
+			K:  ins.K,
+		}
+	}
+
+	return s.TPacket.SetBPF(raw)
+}
+
+func (s *afpacketSource) Close() {
+	s.TPacket.Close()
+}
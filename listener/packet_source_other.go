@@ -0,0 +1,12 @@
+//go:build !linux
+
+package listener
+
+import "fmt"
+
+// NewAFPacketSource is only implemented on Linux (see
+// packet_source_linux.go); elsewhere the "af_packet://" device scheme
+// fails fast with a clear error instead of being silently unavailable.
+func NewAFPacketSource(device string, snaplen int) (PacketSource, error) {
+	return nil, fmt.Errorf("af_packet capture is only supported on linux, got device %q", device)
+}
@@ -0,0 +1,136 @@
+package listener
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// dumpWriter tees every packet it is given to a pcap file via pcapgo.Writer,
+// rotating the underlying file by size or age so a long-running capture
+// doesn't grow without bound. This lets operators record a production
+// traffic-replay session once and feed it back in locally through
+// NewOfflinePacketSource.
+//
+// A single dumpWriter is shared across every capture source when
+// RAWTCPListener binds multiple interfaces, so all access to its state is
+// guarded by mu.
+type dumpWriter struct {
+	mu sync.Mutex
+
+	path     string
+	linkType layers.LinkType
+
+	maxSize     int64
+	maxInterval time.Duration
+
+	file   *os.File
+	writer *pcapgo.Writer
+	size   int64
+	opened time.Time
+
+	rotations int // completed rotations, used to give each retired file a distinct name
+}
+
+func newDumpWriter(path string, linkType layers.LinkType, maxSize int64, maxInterval time.Duration) (*dumpWriter, error) {
+	d := &dumpWriter{
+		path:        path,
+		linkType:    linkType,
+		maxSize:     maxSize,
+		maxInterval: maxInterval,
+	}
+
+	if err := d.rotate(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *dumpWriter) rotate() error {
+	if d.file != nil {
+		d.file.Close()
+
+		// Keep d.path as the live file but retire what's been captured so
+		// far under its own name, rather than truncating it away.
+		d.rotations++
+
+		if err := os.Rename(d.path, fmt.Sprintf("%s.%d", d.path, d.rotations)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(d.path)
+	if err != nil {
+		return err
+	}
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, d.linkType); err != nil {
+		f.Close()
+		return err
+	}
+
+	d.file = f
+	d.writer = w
+	d.size = 0
+	d.opened = time.Now()
+
+	return nil
+}
+
+func (d *dumpWriter) needsRotation() bool {
+	if d.maxSize > 0 && d.size >= d.maxSize {
+		return true
+	}
+
+	if d.maxInterval > 0 && time.Since(d.opened) >= d.maxInterval {
+		return true
+	}
+
+	return false
+}
+
+// WritePacket appends packet to the dump, rotating the file first if it has
+// grown past the configured size or age limit. Safe to call concurrently,
+// e.g. from one readRAWSocket goroutine per captured interface.
+func (d *dumpWriter) WritePacket(packet gopacket.Packet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.needsRotation() {
+		if err := d.rotate(); err != nil {
+			log.Println("Error rotating dump file", d.path, err)
+			return
+		}
+	}
+
+	ci := packet.Metadata().CaptureInfo
+	if err := d.writer.WritePacket(ci, packet.Data()); err != nil {
+		log.Println("Error writing packet to dump file", d.path, err)
+	}
+
+	d.size += int64(ci.CaptureLength)
+}
+
+// Close flushes and releases the dump file. Safe to call more than once;
+// later calls are a no-op.
+func (d *dumpWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+
+	err := d.file.Close()
+	d.file = nil
+
+	return err
+}
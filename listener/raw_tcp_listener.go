@@ -1,8 +1,13 @@
 package listener
 
 import (
+	"container/list"
 	"log"
-	pcap "github.com/akrennmair/gopcap"
+	"strconv"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 // Capture traffic from socket using RAW_SOCKET's
@@ -12,131 +17,318 @@ import (
 // Ports is TCP feature, same as flow control, reliable transmission and etc.
 // Since we can't use default TCP libraries RAWTCPLitener implements own TCP layer
 // TCP packets is parsed using tcp_packet.go, and flow control is managed by tcp_message.go
+//
+// Packets are captured through a PacketSource (see packet_source.go), which
+// may be a live NIC, a recorded pcap file, or an af_packet socket, letting
+// the same processing path run against canned traffic in tests.
 type RAWTCPListener struct {
-	messages map[uint32]*TCPMessage // buffer of TCPMessages waiting to be send
+	messages map[messageKey]*TCPMessage // buffer of TCPMessages waiting to be send
+	active   map[tcpTuple]messageKey    // the in-flight message key for each connection
+
+	order *list.List                   // messageKeys in creation order, oldest first, so the oldest can be evicted under MaxInFlightMessages
+	elems map[messageKey]*list.Element // back-reference into order for O(1) removal
 
-	c_packets  chan *pcap.Packet
+	c_packets  chan gopacket.Packet
 	c_messages chan *TCPMessage // Messages ready to be send to client
 
-	sniffer *pcap.Pcap
+	sources []PacketSource
+	dump    *dumpWriter // optional tee of every captured packet, see config.DumpFile
 
 	c_del_message chan *TCPMessage // Used for notifications about completed or expired messages
 
-	device string // device to listen
-	port int    // Port to listen
+	done      chan struct{} // closed by Close to stop the listen loop and unblock Receive
+	closeOnce sync.Once
+
+	// Metrics tracks packet/message counters for this listener; see
+	// the Metrics type for details.
+	Metrics Metrics
+
+	device string // device, IP/CIDR to resolve to devices, or file:// address to listen
+	port   int    // Port to listen
+	config RAWListenerConfig
 }
 
-// RAWTCPListen creates a listener to capture traffic from RAW_SOCKET
-func RAWTCPListen(device string, port int) (listener *RAWTCPListener) {
+// RAWTCPListen creates a listener to capture traffic from RAW_SOCKET.
+//
+// device accepts a network interface name, an IP/CIDR resolved via
+// findPcapDevices to every matching interface (for bonded/multi-homed
+// hosts), a "file://path/to/dump.pcap" address to replay a previously
+// recorded session through the offline PacketSource instead, or an
+// "af_packet://eth0" address to capture through a Linux AF_PACKET socket
+// (see packet_source_linux.go) rather than libpcap's live-capture path.
+func RAWTCPListen(device string, port int, config RAWListenerConfig) (listener *RAWTCPListener) {
 	listener = &RAWTCPListener{}
 
-	listener.c_packets = make(chan *pcap.Packet, 100)
+	listener.c_packets = make(chan gopacket.Packet, 100)
 	listener.c_messages = make(chan *TCPMessage, 100)
 	listener.c_del_message = make(chan *TCPMessage, 100)
-	listener.messages = make(map[uint32]*TCPMessage)
+	listener.messages = make(map[messageKey]*TCPMessage)
+	listener.active = make(map[tcpTuple]messageKey)
+	listener.order = list.New()
+	listener.elems = make(map[messageKey]*list.Element)
+	listener.done = make(chan struct{})
 
 	listener.device = device
 	listener.port = port
+	listener.config = config
 
 	listener.startSniffer()
 
 	go listener.listen()
-	go listener.readRAWSocket()
 
 	return
 }
 
+// startSniffer resolves t.device into one or more PacketSources (or a
+// single offline replay or AF_PACKET source) and starts a reader goroutine
+// for each, fanning every matching packet into the shared c_packets
+// channel.
+func (t *RAWTCPListener) startSniffer() {
+	if path, ok := stripFileScheme(t.device); ok {
+		source, err := NewOfflinePacketSource(path)
+
+		if err != nil {
+			log.Fatal("Error while trying to listen", err)
+		}
+
+		t.addSource(source)
+
+		return
+	}
+
+	if device, ok := stripAFPacketScheme(t.device); ok {
+		source, err := NewAFPacketSource(device, 65536)
+
+		if err != nil {
+			log.Fatal("Error while trying to listen on", device, err)
+		}
+
+		t.addSource(source)
+
+		return
+	}
+
+	devices, err := findPcapDevices(t.device)
+
+	if err != nil {
+		log.Fatal("Error while resolving capture devices", err)
+	}
+
+	for _, device := range devices {
+		source, err := NewLivePacketSource(device, 4026, true, 0)
+
+		if err != nil {
+			log.Fatal("Error while trying to listen on", device, err)
+		}
+
+		t.addSource(source)
+	}
+}
+
+// addSource applies the configured (or default) BPF filter to source,
+// wires it into the optional packet dump, and starts reading from it.
+func (t *RAWTCPListener) addSource(source PacketSource) {
+	filter := t.config.BPFFilter
+	if filter == "" {
+		filter = "tcp dst port " + strconv.Itoa(t.port)
+	}
+
+	if err := source.SetBPFFilter(filter); err != nil {
+		log.Fatal("Error while setting BPF filter", err)
+	}
+
+	if t.config.DumpFile != "" && t.dump == nil {
+		dump, err := newDumpWriter(t.config.DumpFile, source.LinkType(), t.config.DumpRotateSize, t.config.DumpRotateInterval)
+
+		if err != nil {
+			log.Fatal("Error while opening dump file", err)
+		}
+
+		t.dump = dump
+	}
+
+	t.sources = append(t.sources, source)
+
+	go t.readRAWSocket(source)
+}
+
+// Close stops every capture source (which unblocks their read loops),
+// winds down the listen loop, and unblocks any pending Receive call, which
+// then returns nil. It is safe to call more than once. The dump file, if
+// any, is flushed and released as part of shutdown.
+func (t *RAWTCPListener) Close() error {
+	t.closeOnce.Do(func() {
+		for _, source := range t.sources {
+			source.Close()
+		}
+
+		close(t.done)
+	})
+
+	if t.dump == nil {
+		return nil
+	}
+
+	return t.dump.Close()
+}
+
 func (t *RAWTCPListener) listen() {
 	for {
 		select {
 		// If message ready for deletion it means that its also complete or expired by timeout
 		case message := <-t.c_del_message:
 			t.c_messages <- message
-			delete(t.messages, message.Ack)
+			t.forgetMessage(message)
 
 		// We need to use channels to process each packet to avoid data races
 		case packet := <-t.c_packets:
 			t.processTCPPacket(packet)
+
+		case <-t.done:
+			t.drainMessages()
+			close(t.c_messages)
+
+			return
 		}
 	}
 }
 
-func (t *RAWTCPListener) startSniffer() {
-	devices, err := pcap.Findalldevs()
+// drainMessages forces every still in-flight message to flush immediately
+// and waits for each to report back on c_del_message. Without this, a
+// message that later hit its idle timeout or got Expire()-evicted would
+// try to send on c_del_message after listen() had already stopped reading
+// it, leaking its listen() goroutine once the channel's buffer filled up.
+func (t *RAWTCPListener) drainMessages() {
+	for _, message := range t.messages {
+		message.Expire()
+	}
 
-	if err != nil {
-		log.Fatal("Error while getting device list", err)
+	for len(t.messages) > 0 {
+		message := <-t.c_del_message
+		t.c_messages <- message
+		t.forgetMessage(message)
 	}
+}
 
-	networkInterface := ""
+// forgetMessage removes message from every bookkeeping structure once it
+// has been delivered, and updates the in-flight/expired counters.
+func (t *RAWTCPListener) forgetMessage(message *TCPMessage) {
+	delete(t.messages, message.key)
 
-	for _, device := range devices {
-		if device.Name == Settings.Device {
-			networkInterface = device.Name
-			break
-		}
+	if t.active[message.key.tcpTuple] == message.key {
+		delete(t.active, message.key.tcpTuple)
 	}
 
-	if networkInterface == "" {
-		log.Fatal("Could not find network interface", Settings.Device)
+	if elem, ok := t.elems[message.key]; ok {
+		t.order.Remove(elem)
+		delete(t.elems, message.key)
 	}
 
-	h, err := pcap.Openlive(networkInterface, int32(4026), true, 0)
-	h.Setfilter("tcp dst port " + string(t.port))
+	t.Metrics.MessagesInFlight.Add(-1)
 
-	if err != nil {
-		log.Fatal("Error while trying to listen", err)
+	if message.expired {
+		t.Metrics.MessagesExpired.Add(1)
 	}
+}
+
+// evictOldest expires the longest-lived in-flight message to make room for
+// a new one once RAWListenerConfig.MaxInFlightMessages is exceeded. The
+// eviction itself is reported through the normal c_del_message path, same
+// as an idle timeout.
+func (t *RAWTCPListener) evictOldest() {
+	front := t.order.Front()
 
-	t.sniffer = h
+	if front == nil {
+		return
+	}
+
+	key := front.Value.(messageKey)
+
+	if message, ok := t.messages[key]; ok {
+		message.Expire()
+	}
 }
 
-func (t *RAWTCPListener) readRAWSocket() {
-	for {
-		// Note: ReadFrom receive messages without IP header
-		pkt := t.sniffer.Next()
+func (t *RAWTCPListener) readRAWSocket(source PacketSource) {
+	packetSource := gopacket.NewPacketSource(source, source.LinkType())
 
-		if pkt == nil {
-			continue
+	for packet := range packetSource.Packets() {
+		if t.dump != nil {
+			t.dump.WritePacket(packet)
 		}
 
-		pkt.Decode()
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
 
-		if len(pkt.Headers) < 2 {
+		if !ok {
 			continue
 		}
 
-		switch pkt.Headers[1].(type) {
-		case *pcap.Tcphdr:
-			header := pkt.Headers[1].(*pcap.Tcphdr)
-			port := int(header.DestPort)
-			if port == t.port && (header.Flags & pcap.TCP_PSH) != 0 {
-				t.c_packets <- pkt
-			}
+		// A custom BPFFilter alone decides which packets are kept; only the
+		// default filter is tied to the listener's destination port.
+		if t.config.BPFFilter == "" && int(tcp.DstPort) != t.port {
+			continue
+		}
+
+		select {
+		case t.c_packets <- packet:
+			t.Metrics.PacketsReceived.Add(1)
+		default:
+			t.Metrics.PacketsDropped.Add(1)
 		}
 	}
 }
 
 // Trying to add packet to existing message or creating new message
 //
-// For TCP message unique id is Acknowledgment number (see tcp_packet.go)
-func (t *RAWTCPListener) processTCPPacket(packet *pcap.Packet) {
-	var message *TCPMessage
-	ack := packet.Headers[1].(*pcap.Tcphdr).Ack
+// Messages are keyed by the connection 4-tuple plus the initial SEQ of the
+// request (see tcp_message.go), so the first data-carrying packet seen for a
+// tuple opens a new message and every later packet on that same connection is routed
+// to it until it completes and the tuple is freed for the next request.
+func (t *RAWTCPListener) processTCPPacket(packet gopacket.Packet) {
+	tcp, tuple, ok := decodeTCP(packet)
+	if !ok {
+		// No TCP layer, or no IPv4/IPv6 layer could be decoded underneath
+		// it, e.g. an encapsulation gopacket doesn't know how to unwrap.
+		// Drop it rather than guess.
+		return
+	}
 
-	message, ok := t.messages[ack]
+	key, ok := t.active[tuple]
+	if !ok {
+		if len(tcp.Payload) == 0 {
+			// No in-flight message for this connection, and this packet
+			// (the handshake SYN, a bare ACK, ...) carries no data to
+			// start one with. Starting a message here would lock its
+			// baseline seq to the wrong value, e.g. the SYN's ISN
+			// instead of the first data segment's seq, so reassemble
+			// would never see a segment matching m.next.
+			return
+		}
+
+		key = messageKey{tcpTuple: tuple, seq: tcp.Seq}
+		t.active[tuple] = key
+	}
+
+	message, ok := t.messages[key]
 
 	if !ok {
 		// We sending c_del_message channel, so message object can communicate with Listener and notify it if message completed
-		message = NewTCPMessage(ack, t.c_del_message)
-		t.messages[ack] = message
+		message = NewTCPMessage(key, t.c_del_message)
+		t.messages[key] = message
+		t.elems[key] = t.order.PushBack(key)
+		t.Metrics.MessagesInFlight.Add(1)
+
+		if max := t.config.MaxInFlightMessages; max > 0 && t.order.Len() > max {
+			t.evictOldest()
+		}
 	}
 
 	// Adding packet to message
 	message.c_packets <- packet
 }
 
-// Receive TCP messages from the listener channel
+// Receive TCP messages from the listener channel. It returns nil once
+// Close has been called and every pending message has been delivered.
 func (t *RAWTCPListener) Receive() *TCPMessage {
 	return <-t.c_messages
 }
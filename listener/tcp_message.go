@@ -0,0 +1,253 @@
+package listener
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// idleTimeout bounds how long a TCPMessage waits for more segments of its
+// stream before it is flushed with whatever has been reassembled so far.
+const idleTimeout = 2 * time.Second
+
+// tcpTuple identifies one TCP connection, independent of which request is
+// currently in flight on it. srcIP/dstIP are the textual form of whatever
+// network-layer endpoints gopacket decoded the packet down to (IPv4 or
+// IPv6, underneath any VLAN/GRE/PPPoE encapsulation), which keeps the two
+// families from ever colliding without needing a separate version field.
+type tcpTuple struct {
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+}
+
+// messageKey identifies a single TCPMessage: the connection it belongs to,
+// plus the sequence number of the first segment that started it. Keying on
+// the initial SEQ (rather than e.g. the ACK, which is shared by every
+// packet of a request) lets back-to-back requests on a keep-alive
+// connection be told apart.
+type messageKey struct {
+	tcpTuple
+	seq uint32
+}
+
+func newTCPTuple(tcp *layers.TCP, srcIP, dstIP string) tcpTuple {
+	return tcpTuple{
+		srcIP:   srcIP,
+		dstIP:   dstIP,
+		srcPort: uint16(tcp.SrcPort),
+		dstPort: uint16(tcp.DstPort),
+	}
+}
+
+// decodeTCP extracts the TCP layer and connection tuple from packet,
+// regardless of what link/network layers gopacket decoded it down through
+// (Ethernet, Dot1Q, IPv4, IPv6, GRE, PPPoE, ...). ok is false if packet
+// carries no TCP layer or gopacket couldn't resolve a network layer for it.
+func decodeTCP(packet gopacket.Packet) (tcp *layers.TCP, tuple tcpTuple, ok bool) {
+	tcp, ok = packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, tcpTuple{}, false
+	}
+
+	// Use the innermost network layer, the one carrying the TCP segment,
+	// rather than a tunnel's outer IP header.
+	var network gopacket.NetworkLayer
+	for _, layer := range packet.Layers() {
+		if n, isNetwork := layer.(gopacket.NetworkLayer); isNetwork {
+			network = n
+		}
+	}
+	if network == nil {
+		return nil, tcpTuple{}, false
+	}
+
+	src, dst := network.NetworkFlow().Endpoints()
+
+	return tcp, newTCPTuple(tcp, src.String(), dst.String()), true
+}
+
+// TCPMessage reassembles a single HTTP request out of the TCP segments
+// that carry it, tolerating out-of-order delivery and retransmissions.
+// Segments are fed in as they arrive off the wire through c_packets; once
+// the message is complete (an HTTP request boundary is reached, a FIN/RST
+// is observed, or the connection goes idle) it sends itself on
+// c_del_message for delivery through RAWTCPListener.Receive().
+type TCPMessage struct {
+	key messageKey
+
+	c_packets     chan gopacket.Packet
+	c_del_message chan *TCPMessage
+
+	segments map[uint32][]byte // payload keyed by its starting sequence number; the map key dedupes retransmissions of an identical segment
+
+	data []byte // contiguous payload reassembled so far, starting at key.seq
+	next uint32 // sequence number expected to extend data
+
+	headerEnd     int // byte offset where the body starts, once the blank line ending the headers has been seen
+	contentLength int // Content-Length header value, or -1 until known
+	chunked       bool
+
+	done    bool
+	expired bool // true if flushed by idle timeout or a forced Expire, rather than a clean boundary/FIN/RST
+
+	expire     chan struct{}
+	expireOnce sync.Once
+}
+
+// NewTCPMessage creates a TCPMessage for a new request identified by key,
+// notifying c_del_message once it is complete.
+func NewTCPMessage(key messageKey, c_del_message chan *TCPMessage) *TCPMessage {
+	message := &TCPMessage{
+		key:           key,
+		c_packets:     make(chan gopacket.Packet, 100),
+		c_del_message: c_del_message,
+		segments:      make(map[uint32][]byte),
+		next:          key.seq,
+		contentLength: -1,
+		expire:        make(chan struct{}),
+	}
+
+	go message.listen()
+
+	return message
+}
+
+// Expire forces the message to flush immediately with whatever has been
+// reassembled so far, as if the idle timeout had fired. RAWTCPListener
+// calls this to evict the oldest in-flight message once
+// RAWListenerConfig.MaxInFlightMessages is exceeded, bounding memory
+// under a flood of half-open connections. It is safe to call more than
+// once, e.g. if eviction runs again for the same message before its
+// c_del_message notification has been drained.
+func (m *TCPMessage) Expire() {
+	m.expireOnce.Do(func() {
+		close(m.expire)
+	})
+}
+
+func (m *TCPMessage) listen() {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case packet, ok := <-m.c_packets:
+			if !ok {
+				return
+			}
+
+			timer.Reset(idleTimeout)
+			m.add(packet)
+
+			if m.done {
+				m.c_del_message <- m
+
+				return
+			}
+
+		case <-timer.C:
+			m.expired = true
+			m.c_del_message <- m
+
+			return
+
+		case <-m.expire:
+			m.expired = true
+			m.c_del_message <- m
+
+			return
+		}
+	}
+}
+
+func (m *TCPMessage) add(packet gopacket.Packet) {
+	tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	if len(tcp.Payload) > 0 {
+		if _, seen := m.segments[tcp.Seq]; !seen {
+			m.segments[tcp.Seq] = tcp.Payload
+			m.reassemble()
+		}
+	}
+
+	if tcp.FIN || tcp.RST || m.boundaryReached() {
+		m.done = true
+	}
+}
+
+// reassemble folds any buffered segments that extend the contiguous
+// prefix of data into it, so an out-of-order segment is picked up as soon
+// as the gap before it is filled.
+func (m *TCPMessage) reassemble() {
+	for {
+		payload, ok := m.segments[m.next]
+
+		if !ok {
+			return
+		}
+
+		m.data = append(m.data, payload...)
+		delete(m.segments, m.next)
+		m.next += uint32(len(payload))
+	}
+}
+
+// boundaryReached reports whether enough of the HTTP request has been
+// reassembled to deliver it: headers plus a Content-Length body, the
+// final zero-length chunk of a chunked body, or just the headers when
+// neither Content-Length nor chunked Transfer-Encoding is set, whatever
+// the request method (as for a typical GET/HEAD/DELETE).
+func (m *TCPMessage) boundaryReached() bool {
+	if m.headerEnd == 0 {
+		idx := bytes.Index(m.data, []byte("\r\n\r\n"))
+
+		if idx == -1 {
+			return false
+		}
+
+		m.headerEnd = idx + 4
+		m.parseHeaders(m.data[:idx])
+	}
+
+	body := m.data[m.headerEnd:]
+
+	switch {
+	case m.chunked:
+		return bytes.HasSuffix(body, []byte("0\r\n\r\n"))
+	case m.contentLength >= 0:
+		return len(body) >= m.contentLength
+	default:
+		return true
+	}
+}
+
+func (m *TCPMessage) parseHeaders(headers []byte) {
+	for _, line := range bytes.Split(headers, []byte("\r\n")) {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(string(name))) {
+		case "content-length":
+			if n, err := strconv.Atoi(strings.TrimSpace(string(value))); err == nil {
+				m.contentLength = n
+			}
+		case "transfer-encoding":
+			if strings.Contains(strings.ToLower(string(value)), "chunked") {
+				m.chunked = true
+			}
+		}
+	}
+}
+
+// Data returns the reassembled request as sent over the wire.
+func (m *TCPMessage) Data() []byte {
+	return m.data
+}
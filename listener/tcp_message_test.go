@@ -0,0 +1,163 @@
+package listener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildTCPPacket serializes an Ethernet frame carrying network (optionally
+// preceded by a Dot1Q tag) and a TCP segment, then decodes it back through
+// gopacket the same way readRAWSocket would for a live capture. This
+// stands in for a canned pcap fixture without needing a binary blob on
+// disk for each encapsulation.
+func buildTCPPacket(t *testing.T, vlan bool, network gopacket.SerializableLayer, tcp *layers.TCP) gopacket.Packet {
+	t.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+	}
+
+	layerStack := []gopacket.SerializableLayer{eth}
+
+	if vlan {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		layerStack = append(layerStack, &layers.Dot1Q{VLANIdentifier: 100, Type: networkEthernetType(network)})
+	} else {
+		eth.EthernetType = networkEthernetType(network)
+	}
+
+	layerStack = append(layerStack, network, tcp)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if err := gopacket.SerializeLayers(buf, opts, layerStack...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func networkEthernetType(network gopacket.SerializableLayer) layers.EthernetType {
+	switch network.(type) {
+	case *layers.IPv6:
+		return layers.EthernetTypeIPv6
+	default:
+		return layers.EthernetTypeIPv4
+	}
+}
+
+func TestDecodeTCP_IPv4(t *testing.T) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 12345, DstPort: 80, Seq: 1000, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	packet := buildTCPPacket(t, false, ip, tcp)
+
+	_, tuple, ok := decodeTCP(packet)
+	if !ok {
+		t.Fatalf("decodeTCP: expected ok=true")
+	}
+
+	if tuple.srcIP != "10.0.0.1" || tuple.dstIP != "10.0.0.2" {
+		t.Errorf("tuple = %+v, want srcIP=10.0.0.1 dstIP=10.0.0.2", tuple)
+	}
+
+	if tuple.srcPort != 12345 || tuple.dstPort != 80 {
+		t.Errorf("tuple ports = %d/%d, want 12345/80", tuple.srcPort, tuple.dstPort)
+	}
+}
+
+func TestDecodeTCP_IPv6(t *testing.T) {
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolTCP,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	tcp := &layers.TCP{SrcPort: 12345, DstPort: 443, Seq: 2000, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	packet := buildTCPPacket(t, false, ip, tcp)
+
+	_, tuple, ok := decodeTCP(packet)
+	if !ok {
+		t.Fatalf("decodeTCP: expected ok=true")
+	}
+
+	if tuple.srcIP != "2001:db8::1" || tuple.dstIP != "2001:db8::2" {
+		t.Errorf("tuple = %+v, want srcIP=2001:db8::1 dstIP=2001:db8::2", tuple)
+	}
+}
+
+func TestDecodeTCP_VLANTagged(t *testing.T) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(192, 168, 1, 1),
+		DstIP:    net.IPv4(192, 168, 1, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 54321, DstPort: 8080, Seq: 3000, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	packet := buildTCPPacket(t, true, ip, tcp)
+
+	_, tuple, ok := decodeTCP(packet)
+	if !ok {
+		t.Fatalf("decodeTCP: expected ok=true through a Dot1Q-tagged frame")
+	}
+
+	if tuple.srcIP != "192.168.1.1" || tuple.dstIP != "192.168.1.2" {
+		t.Errorf("tuple = %+v, want srcIP=192.168.1.1 dstIP=192.168.1.2", tuple)
+	}
+
+	if tuple.dstPort != 8080 {
+		t.Errorf("tuple.dstPort = %d, want 8080", tuple.dstPort)
+	}
+}
+
+func TestDecodeTCP_NoNetworkLayer(t *testing.T) {
+	// A bare Ethernet frame with no IPv4/IPv6 payload (e.g. ARP) has no
+	// network layer for decodeTCP to resolve a tuple from.
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		SourceProtAddress: []byte{10, 0, 0, 1},
+		DstHwAddress:      []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		DstProtAddress:    []byte{10, 0, 0, 2},
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if err := gopacket.SerializeLayers(buf, opts, eth, arp); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+
+	if _, _, ok := decodeTCP(packet); ok {
+		t.Errorf("decodeTCP: expected ok=false for an ARP packet")
+	}
+}
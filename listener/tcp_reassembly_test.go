@@ -0,0 +1,213 @@
+package listener
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpSegment serializes a single IPv4 TCP segment carrying payload at seq,
+// parsed back through gopacket the same way processTCPPacket would receive
+// it off the wire.
+func tcpSegment(t *testing.T, seq uint32, payload []byte, fin, rst bool) gopacket.Packet {
+	t.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{
+		SrcPort: 12345,
+		DstPort: 80,
+		Seq:     seq,
+		PSH:     len(payload) > 0,
+		FIN:     fin,
+		RST:     rst,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	layerStack := []gopacket.SerializableLayer{eth, ip, tcp}
+	if len(payload) > 0 {
+		layerStack = append(layerStack, gopacket.Payload(payload))
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if err := gopacket.SerializeLayers(buf, opts, layerStack...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func newTestMessage(seq uint32) (*TCPMessage, chan *TCPMessage) {
+	cDel := make(chan *TCPMessage, 1)
+	tuple := tcpTuple{srcIP: "10.0.0.1", dstIP: "10.0.0.2", srcPort: 12345, dstPort: 80}
+	message := NewTCPMessage(messageKey{tcpTuple: tuple, seq: seq}, cDel)
+
+	return message, cDel
+}
+
+func recvMessage(t *testing.T, cDel chan *TCPMessage) *TCPMessage {
+	t.Helper()
+
+	select {
+	case m := <-cDel:
+		return m
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message to flush")
+
+		return nil
+	}
+}
+
+func TestTCPMessage_OutOfOrderReassembly(t *testing.T) {
+	const seq = 1000
+
+	first := []byte("GET / HTTP/1.1\r\n")
+	second := []byte("Host: example.com\r\n\r\n")
+
+	message, cDel := newTestMessage(seq)
+
+	// Deliver the second segment before the first: it should be buffered,
+	// not lost, until the gap in front of it is filled.
+	message.c_packets <- tcpSegment(t, seq+uint32(len(first)), second, false, false)
+	message.c_packets <- tcpSegment(t, seq, first, false, false)
+
+	got := recvMessage(t, cDel)
+
+	if !got.done || got.expired {
+		t.Fatalf("done=%v expired=%v, want done=true expired=false", got.done, got.expired)
+	}
+
+	want := string(first) + string(second)
+	if string(got.Data()) != want {
+		t.Errorf("Data() = %q, want %q", got.Data(), want)
+	}
+}
+
+func TestTCPMessage_RetransmitDedup(t *testing.T) {
+	const seq = 2000
+
+	first := []byte("GET /ping HTTP/1.1\r\n")
+	second := []byte("Host: x\r\n\r\n")
+	payload := append(append([]byte{}, first...), second...)
+
+	message, cDel := newTestMessage(seq)
+
+	message.c_packets <- tcpSegment(t, seq, first, false, false)
+	// Retransmission of the exact same segment must not be appended twice.
+	// The first segment does not end the headers, so the message is still
+	// open when the retransmit arrives.
+	message.c_packets <- tcpSegment(t, seq, first, false, false)
+	message.c_packets <- tcpSegment(t, seq+uint32(len(first)), second, false, false)
+
+	got := recvMessage(t, cDel)
+
+	if string(got.Data()) != string(payload) {
+		t.Errorf("Data() = %q, want %q (retransmit should be deduped)", got.Data(), payload)
+	}
+}
+
+func TestTCPMessage_ContentLengthBoundary(t *testing.T) {
+	const seq = 3000
+
+	headers := []byte("POST /submit HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\n")
+	bodyPart1 := []byte("hel")
+	bodyPart2 := []byte("lo")
+
+	message, cDel := newTestMessage(seq)
+
+	message.c_packets <- tcpSegment(t, seq, headers, false, false)
+	message.c_packets <- tcpSegment(t, seq+uint32(len(headers)), bodyPart1, false, false)
+	message.c_packets <- tcpSegment(t, seq+uint32(len(headers)+len(bodyPart1)), bodyPart2, false, false)
+
+	got := recvMessage(t, cDel)
+
+	want := string(headers) + string(bodyPart1) + string(bodyPart2)
+	if string(got.Data()) != want {
+		t.Errorf("Data() = %q, want %q", got.Data(), want)
+	}
+
+	if !got.done || got.expired {
+		t.Fatalf("done=%v expired=%v, want done=true expired=false", got.done, got.expired)
+	}
+}
+
+func TestTCPMessage_ChunkedBoundary(t *testing.T) {
+	const seq = 4000
+
+	request := []byte("POST /upload HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n")
+
+	message, cDel := newTestMessage(seq)
+	message.c_packets <- tcpSegment(t, seq, request, false, false)
+
+	got := recvMessage(t, cDel)
+
+	if string(got.Data()) != string(request) {
+		t.Errorf("Data() = %q, want %q", got.Data(), request)
+	}
+
+	if !got.done || got.expired {
+		t.Fatalf("done=%v expired=%v, want done=true expired=false", got.done, got.expired)
+	}
+}
+
+func TestTCPMessage_FINFlushesPartialData(t *testing.T) {
+	const seq = 5000
+
+	partial := []byte("GET /incomplete HTTP/1.1\r\nHost: x\r\n")
+
+	message, cDel := newTestMessage(seq)
+	message.c_packets <- tcpSegment(t, seq, partial, false, false)
+	message.c_packets <- tcpSegment(t, seq+uint32(len(partial)), nil, true, false)
+
+	got := recvMessage(t, cDel)
+
+	if !got.done {
+		t.Fatalf("done=%v, want true after FIN", got.done)
+	}
+
+	if got.expired {
+		t.Errorf("expired=true, want false: a clean FIN is not a forced expiry")
+	}
+
+	if string(got.Data()) != string(partial) {
+		t.Errorf("Data() = %q, want %q", got.Data(), partial)
+	}
+}
+
+func TestTCPMessage_IdleTimeoutFlushesPartialData(t *testing.T) {
+	const seq = 6000
+
+	partial := []byte("GET /stalled HTTP/1.1\r\nHost: x\r\n")
+
+	message, cDel := newTestMessage(seq)
+	message.c_packets <- tcpSegment(t, seq, partial, false, false)
+
+	select {
+	case got := <-cDel:
+		if !got.expired {
+			t.Errorf("expired=false, want true after idle timeout")
+		}
+
+		if string(got.Data()) != string(partial) {
+			t.Errorf("Data() = %q, want %q", got.Data(), partial)
+		}
+	case <-time.After(idleTimeout + 2*time.Second):
+		t.Fatal("message never flushed on idle timeout")
+	}
+}